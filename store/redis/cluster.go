@@ -0,0 +1,178 @@
+package redis
+
+import (
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v3"
+)
+
+// cmdable covers the subset of *redis.Client commands the Redis store
+// uses. *redis.Client, *redis.ClusterClient and *redis.FailoverClient
+// (which is really a *redis.Client under a different constructor) all
+// satisfy it, which is what lets Put/Get/Delete/Exists/List/DeleteTree/
+// AtomicPut/AtomicDelete work the same way regardless of topology.
+//
+// Pipeline() and PSubscribe() are deliberately absent: *redis.Client and
+// *redis.ClusterClient return different concrete pipeline types from
+// Pipeline(), and PSubscribe() only exists on *redis.Client at all. See
+// newPipeline below for pipelining, and Watch/WatchTree in watch.go for
+// pubsub.
+type cmdable interface {
+	Get(key string) *redis.StringCmd
+	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	Del(keys ...string) *redis.IntCmd
+	Exists(key string) *redis.BoolCmd
+	MGet(keys ...string) *redis.SliceCmd
+	Scan(cursor int64, match string, count int64) *redis.ScanCmd
+	PExpire(key string, expiration time.Duration) *redis.BoolCmd
+	ConfigSet(parameter, value string) *redis.StatusCmd
+	Eval(script string, keys []string, args []string) *redis.Cmd
+	EvalSha(sha1 string, keys []string, args []string) *redis.Cmd
+	ScriptLoad(script string) *redis.StringCmd
+	Watch(keys ...string) (*redis.Multi, error)
+	Close() error
+}
+
+// pipeliner covers the subset of *redis.Pipeline / *redis.ClusterPipeline
+// that mget and delChunked use. The two types share this shape but aren't
+// unified by any interface in gopkg.in/redis.v3 — *redis.Client.Pipeline()
+// and *redis.ClusterClient.Pipeline() return different concrete types —
+// so newPipeline reaches them through a type switch instead of adding
+// Pipeline() to cmdable.
+type pipeliner interface {
+	MGet(keys ...string) *redis.SliceCmd
+	Del(keys ...string) *redis.IntCmd
+	Exec() ([]redis.Cmder, error)
+	Close() error
+}
+
+// newPipeline opens a pipeline on c, whichever concrete client type it is.
+func newPipeline(c cmdable) pipeliner {
+	switch client := c.(type) {
+	case *redis.ClusterClient:
+		return client.Pipeline()
+	case *redis.Client:
+		return client.Pipeline()
+	default:
+		panic("redis: unsupported cmdable implementation for Pipeline")
+	}
+}
+
+// WithCluster configures the store to talk to a Redis Cluster across the
+// given endpoints instead of a single node. store.Config has no field
+// for this (it predates cluster support), so it's selected explicitly
+// via Option rather than by a Config field.
+func WithCluster() Option {
+	return func(r *Redis) {
+		r.wantCluster = true
+	}
+}
+
+// WithSentinel configures the store to reach a Redis Sentinel-managed
+// master by name, treating endpoints as sentinel addresses, instead of a
+// single node. Like WithCluster, this has no store.Config equivalent.
+func WithSentinel(masterName string) Option {
+	return func(r *Redis) {
+		r.sentinelMaster = masterName
+	}
+}
+
+// newClient builds the concrete go-redis client to use: a
+// *redis.ClusterClient when cluster is true, a *redis.Client obtained
+// from NewFailoverClient when sentinelMaster is set, and a plain
+// *redis.Client otherwise. password is honored in all three modes; db is
+// honored in sentinel and standalone mode and not passed to the cluster
+// client. TLS is rejected by the caller before newClient ever runs, since
+// gopkg.in/redis.v3 has no TLS support at all.
+func newClient(endpoints []string, password string, db int64, cluster bool, sentinelMaster string) (cmdable, error) {
+	if len(endpoints) == 0 {
+		return nil, ErrMultipleEndpointsUnsupported
+	}
+
+	switch {
+	case cluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        endpoints,
+			Password:     password,
+			DialTimeout:  5 * time.Second,
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 30 * time.Second,
+		}), nil
+
+	case sentinelMaster != "":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    sentinelMaster,
+			SentinelAddrs: endpoints,
+			Password:      password,
+			DB:            db,
+			DialTimeout:   5 * time.Second,
+			ReadTimeout:   30 * time.Second,
+			WriteTimeout:  30 * time.Second,
+		}), nil
+
+	default:
+		if len(endpoints) > 1 {
+			return nil, ErrMultipleEndpointsUnsupported
+		}
+		return redis.NewClient(&redis.Options{
+			Addr:         endpoints[0],
+			Password:     password,
+			DB:           db,
+			DialTimeout:  5 * time.Second,
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 30 * time.Second,
+		}), nil
+	}
+}
+
+// clusterSlot mirrors Redis Cluster's key hashing: the slot is computed
+// from the substring inside the first "{...}" hash tag, or the whole key
+// if it has none.
+func clusterSlot(key string) uint16 {
+	tag := key
+	if start := strings.IndexByte(key, '{'); start != -1 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			tag = key[start+1 : start+1+end]
+		}
+	}
+	return crc16(tag) % 16384
+}
+
+// crc16 is the CRC16/XMODEM checksum (poly 0x1021, init 0) Redis Cluster
+// uses to map a hash tag to one of its 16384 slots.
+func crc16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc ^= uint16(data[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = (crc << 1) ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// groupBySlot buckets keys that share a cluster slot together, so
+// multi-key commands built from the result never straddle two slots.
+func groupBySlot(keys []string) [][]string {
+	groups := make(map[uint16][]string)
+	var order []uint16
+	for _, key := range keys {
+		slot := clusterSlot(key)
+		if _, ok := groups[slot]; !ok {
+			order = append(order, slot)
+		}
+		groups[slot] = append(groups[slot], key)
+	}
+
+	batches := make([][]string, 0, len(order))
+	for _, slot := range order {
+		batches = append(batches, groups[slot])
+	}
+	return batches
+}
@@ -0,0 +1,58 @@
+package redis
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestNormalizePrefixMatchesNormalizedKey guards against the bug where
+// normalizePrefix closed the hash-tag brace before the "*", producing a
+// SCAN/PSUBSCRIBE pattern like "{foo/}*" that can never match a stored
+// key "{foo/bar}" (see normalizePrefix's doc comment).
+func TestNormalizePrefixMatchesNormalizedKey(t *testing.T) {
+	for _, cluster := range []bool{false, true} {
+		r := &Redis{cluster: cluster}
+
+		prefix := r.normalizePrefix("foo/")
+		key := r.normalize("foo/bar")
+
+		if !strings.HasPrefix(key, prefix) {
+			t.Fatalf("cluster=%v: normalize(%q) = %q does not have normalizePrefix(%q) = %q as a prefix",
+				cluster, "foo/bar", key, "foo/", prefix)
+		}
+	}
+}
+
+// TestClusterSlotSharedWithVersionKey checks that a key and its sibling
+// version key land on the same cluster slot, which is the reason
+// normalize hash-tags keys in cluster mode at all.
+func TestClusterSlotSharedWithVersionKey(t *testing.T) {
+	r := &Redis{cluster: true}
+	nkey := r.normalize("foo/bar")
+
+	if got, want := clusterSlot(versionKey(nkey)), clusterSlot(nkey); got != want {
+		t.Fatalf("clusterSlot(versionKey) = %d, want %d (same as clusterSlot(key))", got, want)
+	}
+}
+
+func TestGroupBySlot(t *testing.T) {
+	keys := []string{"{a}1", "{a}2", "{b}1", "{a}3", "{b}2"}
+	batches := groupBySlot(keys)
+
+	seen := make(map[string]bool)
+	for _, batch := range batches {
+		slot := clusterSlot(batch[0])
+		for _, key := range batch {
+			if clusterSlot(key) != slot {
+				t.Fatalf("batch %v mixes keys from different slots", batch)
+			}
+			if seen[key] {
+				t.Fatalf("key %q appears in more than one batch", key)
+			}
+			seen[key] = true
+		}
+	}
+	if len(seen) != len(keys) {
+		t.Fatalf("groupBySlot dropped keys: got %d, want %d", len(seen), len(keys))
+	}
+}
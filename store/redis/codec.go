@@ -0,0 +1,108 @@
+package redis
+
+import (
+	"strconv"
+
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// Codec controls how Put/Get/AtomicPut/AtomicDelete serialize values.
+// The default jsonCodec wraps every value together with its CAS version
+// so a single GET/SET round trip is enough to implement atomic
+// operations, via casPutScript/casDelScript, which decode that wrapper
+// with cjson. Codecs that don't embed the version (rawCodec, msgpackCodec)
+// keep it in a sibling key instead and go through atomicPutWatch/
+// atomicDeleteWatch, trading one extra round trip for a primary-key
+// format other tooling can also read: rawCodec stores Value verbatim,
+// msgpackCodec MSGPACK-encodes it.
+type Codec interface {
+	// Encode returns the bytes to store at the primary key, and, unless
+	// EmbedsVersion, the bytes to store at the sibling version key.
+	Encode(value []byte, version uint64) (raw []byte, versionRaw []byte)
+
+	// Decode parses the bytes read back from the primary key (and the
+	// sibling version key, when EmbedsVersion is false) into a value and
+	// its version.
+	Decode(raw []byte, versionRaw []byte) (value []byte, version uint64)
+
+	// EmbedsVersion reports whether Encode folds the version into raw,
+	// meaning no sibling version key is written or read.
+	EmbedsVersion() bool
+}
+
+// jsonCodec is the original format: {"Value":...,"Version":...} marshalled
+// as JSON, so the version always travels with the value.
+type jsonCodec struct{}
+
+func (jsonCodec) EmbedsVersion() bool { return true }
+
+func (jsonCodec) Encode(value []byte, version uint64) ([]byte, []byte) {
+	vv := versionedValue{Value: value, Version: version}
+	return vv.marshal(), nil
+}
+
+func (jsonCodec) Decode(raw []byte, _ []byte) ([]byte, uint64) {
+	var vv versionedValue
+	vv.unmarshal(raw)
+	return vv.Value, vv.Version
+}
+
+// rawCodec stores Value verbatim at the primary key, so it reads back
+// correctly in redis-cli or any other non-libkv client, and keeps the
+// CAS version in a sibling key (see versionKey).
+type rawCodec struct{}
+
+func (rawCodec) EmbedsVersion() bool { return false }
+
+func (rawCodec) Encode(value []byte, version uint64) ([]byte, []byte) {
+	return value, []byte(strconv.FormatUint(version, 10))
+}
+
+func (rawCodec) Decode(raw []byte, versionRaw []byte) ([]byte, uint64) {
+	version, _ := strconv.ParseUint(string(versionRaw), 10, 64)
+	return raw, version
+}
+
+// msgpackCodec MSGPACK-encodes Value at the primary key, unlike rawCodec
+// which stores it verbatim: this wraps it in a self-describing msgpack
+// bin format, for consumers that read the keyspace with a msgpack-aware
+// client rather than redis-cli or libkv itself. The CAS version goes in
+// the sibling version key, also MSGPACK-encoded.
+type msgpackCodec struct{}
+
+func (msgpackCodec) EmbedsVersion() bool { return false }
+
+func (msgpackCodec) Encode(value []byte, version uint64) ([]byte, []byte) {
+	raw, err := msgpack.Marshal(value)
+	if err != nil {
+		panic(err) // shouldn't happen
+	}
+	versionRaw, err := msgpack.Marshal(version)
+	if err != nil {
+		panic(err) // shouldn't happen
+	}
+	return raw, versionRaw
+}
+
+// Decode accepts raw == nil, like rawCodec.Decode: atomicPutWatch and
+// atomicDeleteWatch call Decode(nil, existingVersionRaw) to pull just the
+// version out of the sibling key, without a primary-key value to decode.
+func (msgpackCodec) Decode(raw []byte, versionRaw []byte) ([]byte, uint64) {
+	var value []byte
+	if raw != nil {
+		if err := msgpack.Unmarshal(raw, &value); err != nil {
+			panic(err) // shouldn't happen
+		}
+	}
+	var version uint64
+	if err := msgpack.Unmarshal(versionRaw, &version); err != nil {
+		panic(err) // shouldn't happen
+	}
+	return value, version
+}
+
+// versionKey returns the sibling key a non-embedding codec uses to store
+// a value's CAS version out of band.
+func versionKey(key string) string {
+	return key + ":ver"
+}
@@ -0,0 +1,63 @@
+package redis
+
+import "testing"
+
+func TestCodecRoundTrip(t *testing.T) {
+	codecs := map[string]Codec{
+		"json":    jsonCodec{},
+		"raw":     rawCodec{},
+		"msgpack": msgpackCodec{},
+	}
+
+	for name, codec := range codecs {
+		value := []byte("hello")
+		version := uint64(42)
+
+		raw, versionRaw := codec.Encode(value, version)
+		gotValue, gotVersion := codec.Decode(raw, versionRaw)
+
+		if string(gotValue) != string(value) {
+			t.Errorf("%s: Decode value = %q, want %q", name, gotValue, value)
+		}
+		if gotVersion != version {
+			t.Errorf("%s: Decode version = %d, want %d", name, gotVersion, version)
+		}
+	}
+}
+
+// TestMsgpackCodecDoesNotEmbedVersion guards against the bug where
+// msgpackCodec reported EmbedsVersion() == true while casPutScript/
+// casDelScript can only cjson.decode the primary key's content: that
+// routed msgpack-encoded updates through the Lua CAS path, which threw
+// a raw Lua error trying to cjson.decode msgpack bytes. msgpackCodec
+// must behave like rawCodec and go through the Watch-based CAS path.
+func TestMsgpackCodecDoesNotEmbedVersion(t *testing.T) {
+	if (msgpackCodec{}).EmbedsVersion() {
+		t.Fatal("msgpackCodec.EmbedsVersion() = true, want false (primary key isn't JSON, casPutScript can't CAS it)")
+	}
+
+	raw, versionRaw := (msgpackCodec{}).Encode([]byte("value"), 7)
+	if string(raw) == "value" {
+		t.Fatal("msgpackCodec.Encode primary stored verbatim, want it MSGPACK-encoded (that's what distinguishes it from rawCodec)")
+	}
+	if len(versionRaw) == 0 {
+		t.Fatal("msgpackCodec.Encode returned no sibling version bytes")
+	}
+}
+
+// TestMsgpackCodecDecodeNilRaw guards against the bug where Decode
+// unconditionally msgpack-unmarshalled raw: atomicPutWatch/
+// atomicDeleteWatch call Decode(nil, existingVersionRaw) to read just the
+// sibling version back, with no primary-key value on hand, which used to
+// panic instead of returning the version.
+func TestMsgpackCodecDecodeNilRaw(t *testing.T) {
+	_, versionRaw := (msgpackCodec{}).Encode([]byte("value"), 7)
+
+	gotValue, gotVersion := (msgpackCodec{}).Decode(nil, versionRaw)
+	if gotValue != nil {
+		t.Errorf("msgpackCodec.Decode(nil, ...) value = %q, want nil", gotValue)
+	}
+	if gotVersion != 7 {
+		t.Errorf("msgpackCodec.Decode(nil, ...) version = %d, want 7", gotVersion)
+	}
+}
@@ -0,0 +1,161 @@
+package redis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/hsinhoyeh/libkv/store"
+)
+
+const (
+	// defaultLockTTL is used when LockOptions.TTL is unset.
+	defaultLockTTL = 20 * time.Second
+
+	// lockRetryDelay is how long Lock waits between failed acquire
+	// attempts before retrying.
+	lockRetryDelay = 100 * time.Millisecond
+)
+
+// unlockScript releases a lock only if it is still held by the caller,
+// i.e. the value at KEYS[1] still matches the token this instance set on
+// acquire. This is what makes Unlock safe against a lock that has
+// already expired and been re-acquired by someone else.
+const unlockScript = `if redis.call("GET",KEYS[1])==ARGV[1] then return redis.call("DEL",KEYS[1]) else return 0 end`
+
+// redisLock implements store.Locker on top of a Redis key, following the
+// Redlock pattern: SET NX PX to acquire, a Lua script to release only if
+// still owned, and a background goroutine that PEXPIREs the key so it
+// doesn't expire out from under a long-held lock.
+type redisLock struct {
+	redis *Redis
+	key   string
+	value string
+	ttl   time.Duration
+
+	token     string
+	stopRenew chan struct{}
+	lockHeld  chan struct{}
+	closeOnce sync.Once
+}
+
+// NewLock creates a lock for a given key.
+// The returned Locker is not held and must be acquired
+// with `.Lock`. The Value is optional.
+func (r *Redis) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	value := ""
+	ttl := defaultLockTTL
+	if options != nil {
+		if options.Value != nil {
+			value = string(options.Value)
+		}
+		if options.TTL != 0 {
+			ttl = options.TTL
+		}
+	}
+
+	return &redisLock{
+		redis: r,
+		key:   r.normalize(key),
+		value: value,
+		ttl:   ttl,
+	}, nil
+}
+
+// Lock attempts to acquire the lock, retrying on lockRetryDelay until it
+// succeeds or stopChan fires. The returned channel is closed when the
+// lock is lost, e.g. after Unlock or if the refresh goroutine can no
+// longer reach Redis.
+func (l *redisLock) Lock(stopChan chan struct{}) (<-chan struct{}, error) {
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		ok, err := l.redis.client.SetNX(l.key, token, l.ttl).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+
+		select {
+		case <-time.After(lockRetryDelay):
+		case <-stopChan:
+			return nil, store.ErrAbortTryLock
+		}
+	}
+
+	l.token = token
+	l.stopRenew = make(chan struct{})
+	l.lockHeld = make(chan struct{})
+
+	go l.renew()
+
+	return l.lockHeld, nil
+}
+
+// renew PEXPIREs the lock key at ttl/3 intervals so it stays alive for
+// as long as the process holding it is still running. If it can no
+// longer reach Redis, it gives up the lock rather than let the caller go
+// on believing it still holds it.
+func (l *redisLock) renew() {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.redis.client.PExpire(l.key, l.ttl).Err(); err != nil {
+				l.release()
+				return
+			}
+		case <-l.stopRenew:
+			return
+		}
+	}
+}
+
+// release stops the refresh goroutine and closes lockHeld, signaling
+// that the lock is no longer held. It is idempotent so Unlock and a
+// failed renew can race to call it without double-closing either
+// channel.
+func (l *redisLock) release() {
+	l.closeOnce.Do(func() {
+		close(l.stopRenew)
+		close(l.lockHeld)
+	})
+}
+
+// Unlock releases the lock, stopping the refresh goroutine first so it
+// can't re-extend a key we're about to delete.
+func (l *redisLock) Unlock() error {
+	if l.stopRenew == nil {
+		// Lock never succeeded; nothing to release.
+		return nil
+	}
+	l.release()
+
+	reply, err := l.redis.evalCAS(&l.redis.unlockScriptSHA, unlockScript,
+		[]string{l.key},
+		[]string{l.token},
+	)
+	if err != nil {
+		return err
+	}
+	if reply == 0 {
+		return store.ErrKeyModified
+	}
+	return nil
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
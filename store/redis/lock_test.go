@@ -0,0 +1,34 @@
+package redis
+
+import "testing"
+
+// TestLockReleaseIdempotent guards against the bug where both Unlock and
+// a failed renew could close stopRenew/lockHeld, panicking on
+// close-of-closed-channel when both paths raced or Unlock was called
+// twice.
+func TestLockReleaseIdempotent(t *testing.T) {
+	l := &redisLock{
+		stopRenew: make(chan struct{}),
+		lockHeld:  make(chan struct{}),
+	}
+
+	l.release()
+	l.release() // must not panic
+
+	select {
+	case <-l.lockHeld:
+	default:
+		t.Fatal("release() did not close lockHeld")
+	}
+}
+
+// TestUnlockBeforeLockSucceeded guards against the bug where Unlock,
+// called before Lock ever acquired the key, panicked trying to close a
+// nil stopRenew channel.
+func TestUnlockBeforeLockSucceeded(t *testing.T) {
+	l := &redisLock{}
+
+	if err := l.Unlock(); err != nil {
+		t.Fatalf("Unlock() on a never-acquired lock = %v, want nil", err)
+	}
+}
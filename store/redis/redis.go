@@ -3,6 +3,9 @@ package redis
 import (
 	"encoding/json"
 	"errors"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/hsinhoyeh/libkv"
@@ -13,10 +16,13 @@ import (
 
 var (
 	// ErrMultipleEndpointsUnsupported is thrown when there are
-	// multiple endpoints specified for Redis
-	ErrMultipleEndpointsUnsupported = errors.New("redis does not support multiple endpoints")
+	// multiple endpoints specified for Redis in standalone mode (neither
+	// WithCluster nor WithSentinel given), and also when no endpoint is
+	// given at all, in any mode
+	ErrMultipleEndpointsUnsupported = errors.New("redis does not support multiple endpoints outside of cluster or sentinel mode")
 
-	// ErrTLSUnsupported is thrown when tls config is given
+	// ErrTLSUnsupported is thrown when a TLS config is given: the pinned
+	// client, gopkg.in/redis.v3, has no TLS support at all, in any mode.
 	ErrTLSUnsupported = errors.New("redis does not support tls")
 )
 
@@ -25,31 +31,129 @@ func Register() {
 	libkv.AddStore(store.REDIS, New)
 }
 
-// New creates a new Redis client given a list
-// of endpoints and optional tls config
+// New creates a new Redis client given a list of endpoints and an
+// optional config. By default a single redis.Client is used, which only
+// supports one endpoint; pass WithCluster or WithSentinel to talk to a
+// Redis Cluster or a Sentinel-managed master across multiple endpoints
+// instead. Config.Password is honored in all three modes, and
+// Config.Bucket (as the numeric DB index) in standalone and sentinel mode;
+// cluster mode does not use it. Config.TLS is rejected with
+// ErrTLSUnsupported, since gopkg.in/redis.v3 has no TLS support.
 func New(endpoints []string, options *store.Config) (store.Store, error) {
-	if len(endpoints) > 1 {
-		return nil, ErrMultipleEndpointsUnsupported
+	return NewWithOptions(endpoints, options)
+}
+
+// Option configures behavior of the Redis store that store.Config has no
+// field for, such as a non-default Codec or cluster/sentinel topology.
+type Option func(*Redis)
+
+// WithCodec overrides the default JSON-wrapped Codec used to serialize
+// values. Use a codec that reports EmbedsVersion() == false (such as a
+// raw-value codec) to keep Redis-stored values readable by non-libkv
+// tooling, at the cost of an extra round trip per CAS operation to
+// maintain the sibling version key.
+func WithCodec(codec Codec) Option {
+	return func(r *Redis) {
+		r.codec = codec
+	}
+}
+
+// WithScanCount overrides the default SCAN COUNT hint used by List,
+// DeleteTree and ListCh. Larger values trade more per-call latency for
+// fewer round trips on large keyspaces.
+func WithScanCount(count int64) Option {
+	return func(r *Redis) {
+		r.scanCount = count
+	}
+}
+
+// NewWithOptions creates a new Redis client like New, additionally
+// accepting Options for behavior store.Config cannot express.
+func NewWithOptions(endpoints []string, options *store.Config, opts ...Option) (store.Store, error) {
+	r := &Redis{
+		codec:     jsonCodec{},
+		scanCount: defaultScanCount,
+	}
+	for _, opt := range opts {
+		opt(r)
 	}
+
+	var password string
+	db := int64(0)
 	if options != nil {
-		return nil, ErrTLSUnsupported
+		if options.TLS != nil {
+			return nil, ErrTLSUnsupported
+		}
+		password = options.Password
+		if options.Bucket != "" {
+			parsed, err := strconv.ParseInt(options.Bucket, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			db = parsed
+		}
 	}
 
-	// TODO: use *redis.ClusterClient if we support miltiple endpoints
-	client := redis.NewClient(&redis.Options{
-		Addr:         endpoints[0],
-		DialTimeout:  5 * time.Second,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-	})
+	client, err := newClient(endpoints, password, db, r.wantCluster, r.sentinelMaster)
+	if err != nil {
+		return nil, err
+	}
+	r.client = client
+	r.cluster = r.wantCluster
+	r.password = password
+	r.db = db
 
-	return &Redis{
-		client: client,
-	}, nil
+	if err := r.loadScripts(); err != nil {
+		return nil, err
+	}
+	return r, nil
 }
 
 type Redis struct {
-	client *redis.Client
+	client cmdable
+
+	// cluster is true when client is a *redis.ClusterClient, so normalize
+	// can hash-tag keys to keep each key's sibling version key on the same
+	// slot, and mget/delChunked group multi-key ops by slot.
+	cluster bool
+
+	// wantCluster and sentinelMaster stage the topology requested via
+	// WithCluster/WithSentinel until newClient runs.
+	wantCluster    bool
+	sentinelMaster string
+
+	// password is Config.Password, kept around (beyond being passed to
+	// newClient) so keysCluster can dial per-master *redis.Client
+	// connections with the same credentials.
+	password string
+
+	// db is the selected Redis DB index (Config.Bucket), needed to build
+	// the right keyspace notification channel in Watch/WatchTree. It's
+	// int64 to match redis.Options.DB/redis.FailoverOptions.DB.
+	db int64
+
+	// codec serializes values (and, for codecs that don't embed it, CAS
+	// versions) to and from Redis. Defaults to jsonCodec.
+	codec Codec
+
+	// scanCount is the COUNT hint passed to SCAN by List, DeleteTree and
+	// ListCh. Defaults to defaultScanCount.
+	scanCount int64
+
+	// putScriptSHA, delScriptSHA and unlockScriptSHA cache the SHA1s
+	// returned by SCRIPT LOAD so AtomicPut/AtomicDelete/Unlock can EVALSHA
+	// instead of shipping the script source on every call. evalCAS can
+	// rewrite them concurrently from multiple goroutines on a NOSCRIPT
+	// fallback (e.g. after SCRIPT FLUSH or a Redis restart), so access is
+	// guarded by scriptMu rather than read/written directly.
+	scriptMu        sync.Mutex
+	putScriptSHA    string
+	delScriptSHA    string
+	unlockScriptSHA string
+
+	// watchOnce guards the one-time attempt to enable keyspace
+	// notifications the first time Watch or WatchTree is used.
+	watchOnce sync.Once
 }
 
 const (
@@ -79,6 +183,112 @@ func timeBasedVersion() uint64 {
 	return uint64(time.Now().Nanosecond())
 }
 
+// casPutScript performs a compare-and-swap SET: ARGV[1] is the marshalled
+// value to store, ARGV[2] is "1" when the key must already exist with
+// version ARGV[3], ARGV[4] is an optional PX in milliseconds ("0" for
+// none). It returns 1 on success, 0 when the key was modified since the
+// caller last read it.
+const casPutScript = `
+local current = redis.call("GET", KEYS[1])
+if ARGV[2] == "1" then
+	if current == false then
+		return 0
+	end
+	local decoded = cjson.decode(current)
+	if tostring(decoded["Version"]) ~= ARGV[3] then
+		return 0
+	end
+else
+	if current ~= false then
+		return 0
+	end
+end
+redis.call("SET", KEYS[1], ARGV[1])
+if ARGV[4] ~= "0" then
+	redis.call("PEXPIRE", KEYS[1], ARGV[4])
+end
+return 1
+`
+
+// casDelScript performs a compare-and-swap DEL: ARGV[1] is "1" when the
+// key must already exist with version ARGV[2]. It returns 1 on success,
+// 0 when the key was modified since the caller last read it.
+const casDelScript = `
+local current = redis.call("GET", KEYS[1])
+if ARGV[1] == "1" then
+	if current == false then
+		return 0
+	end
+	local decoded = cjson.decode(current)
+	if tostring(decoded["Version"]) ~= ARGV[2] then
+		return 0
+	end
+else
+	if current ~= false then
+		return 0
+	end
+end
+redis.call("DEL", KEYS[1])
+return 1
+`
+
+// loadScripts uploads the CAS scripts via SCRIPT LOAD and caches their
+// SHA1s so later calls can EVALSHA instead of resending the source.
+func (r *Redis) loadScripts() error {
+	sha, err := r.client.ScriptLoad(casPutScript).Result()
+	if err != nil {
+		return err
+	}
+	r.putScriptSHA = sha
+
+	sha, err = r.client.ScriptLoad(casDelScript).Result()
+	if err != nil {
+		return err
+	}
+	r.delScriptSHA = sha
+
+	sha, err = r.client.ScriptLoad(unlockScript).Result()
+	if err != nil {
+		return err
+	}
+	r.unlockScriptSHA = sha
+
+	return nil
+}
+
+// evalCAS runs one of the CAS scripts via EVALSHA, falling back to EVAL
+// (and refreshing the cached SHA1) if the server reports NOSCRIPT, e.g.
+// after a SCRIPT FLUSH or restart. sha is one of *Redis's cached SHA1
+// fields (putScriptSHA, delScriptSHA, unlockScriptSHA); callers may run
+// concurrently on the same *Redis, so every read and write of *sha goes
+// through scriptMu.
+func (r *Redis) evalCAS(sha *string, src string, keys []string, args []string) (int64, error) {
+	r.scriptMu.Lock()
+	cur := *sha
+	r.scriptMu.Unlock()
+
+	reply, err := r.client.EvalSha(cur, keys, args).Result()
+	if err != nil && strings.Contains(err.Error(), "NOSCRIPT") {
+		newSHA, loadErr := r.client.ScriptLoad(src).Result()
+		if loadErr != nil {
+			return 0, loadErr
+		}
+		r.scriptMu.Lock()
+		*sha = newSHA
+		r.scriptMu.Unlock()
+		reply, err = r.client.Eval(src, keys, args).Result()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, errors.New("redis: unexpected CAS script reply")
+	}
+	return n, nil
+}
+
 // Put a value at the specified key
 func (r *Redis) Put(key string, value []byte, options *store.WriteOptions) error {
 	expirationAfter := noExpiration
@@ -86,41 +296,55 @@ func (r *Redis) Put(key string, value []byte, options *store.WriteOptions) error
 		expirationAfter = options.TTL
 	}
 
-	vv := &versionedValue{
-		Value:   value,
-		Version: timeBasedVersion(),
-	}
-	if err := r.client.Set(r.normalize(key), string(vv.marshal()), expirationAfter).Err(); err != nil {
+	nkey := r.normalize(key)
+	raw, versionRaw := r.codec.Encode(value, timeBasedVersion())
+
+	if err := r.client.Set(nkey, string(raw), expirationAfter).Err(); err != nil {
 		return err
 	}
-	return nil
+	if r.codec.EmbedsVersion() {
+		return nil
+	}
+	return r.client.Set(versionKey(nkey), string(versionRaw), expirationAfter).Err()
 }
 
 // Get a value given its key
 func (r *Redis) Get(key string) (*store.KVPair, error) {
-	reply, err := r.client.Get(r.normalize(key)).Bytes()
+	nkey := r.normalize(key)
+	raw, err := r.client.Get(nkey).Bytes()
 	if err != nil {
 		if err == redis.Nil {
 			return nil, store.ErrKeyNotFound
 		}
 		return nil, err
 	}
-	var vv versionedValue
-	vv.unmarshal(reply)
 
+	var versionRaw []byte
+	if !r.codec.EmbedsVersion() {
+		versionRaw, err = r.client.Get(versionKey(nkey)).Bytes()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+	}
+
+	value, version := r.codec.Decode(raw, versionRaw)
 	return &store.KVPair{
 		Key:       key,
-		Value:     vv.Value,
-		LastIndex: vv.Version,
+		Value:     value,
+		LastIndex: version,
 	}, nil
 }
 
 // Delete the value at the specified key
 func (r *Redis) Delete(key string) error {
-	if err := r.client.Del(r.normalize(key)).Err(); err != nil {
+	nkey := r.normalize(key)
+	if err := r.client.Del(nkey).Err(); err != nil {
 		return err
 	}
-	return nil
+	if r.codec.EmbedsVersion() {
+		return nil
+	}
+	return r.client.Del(versionKey(nkey)).Err()
 }
 
 // Verify if a Key exists in the store
@@ -128,41 +352,125 @@ func (r *Redis) Exists(key string) (bool, error) {
 	return r.client.Exists(r.normalize(key)).Result()
 }
 
+// defaultScanCount is the SCAN COUNT hint used unless overridden with
+// WithScanCount.
+const defaultScanCount = 500
+
+// mgetChunkSize bounds how many keys go into a single MGET/DEL so large
+// trees don't ship one unbounded multi-bulk request that can exceed the
+// proto limit.
+const mgetChunkSize = 1000
+
 // List the content of a given prefix
 func (r *Redis) List(directory string) ([]*store.KVPair, error) {
-	const (
-		startCursor  = 0
-		endCursor    = 0
-		defaultCount = 10
-	)
-
-	var allKeys []string
-	regex := r.normalize(directory) + "*" // for all keyed with $directory
+	regex := r.normalizePrefix(directory) + "*" // for all keyed with $directory
 	allKeys, err := r.keys(regex)
 	if err != nil {
 		return nil, err
 	}
-	// TODO: need to handle when #key is too large
 	return r.mget(allKeys...)
 }
 
+// ListCh streams the content of a given prefix on a channel, so callers
+// iterating over a keyspace too large to buffer in memory (as List
+// would) can process pairs as SCAN pages come in. The error channel
+// receives at most one error, after which both channels are closed.
+func (r *Redis) ListCh(prefix string) (<-chan *store.KVPair, <-chan error) {
+	pairCh := make(chan *store.KVPair)
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer close(pairCh)
+		defer close(errCh)
+
+		regex := r.normalizePrefix(prefix) + "*"
+		cursor := int64(0)
+		for {
+			nextCursor, keys, err := r.client.Scan(cursor, regex, r.scanCount).Result()
+			if err != nil {
+				errCh <- err
+				return
+			}
+
+			if len(keys) > 0 {
+				pairs, err := r.mget(keys...)
+				if err != nil {
+					errCh <- err
+					return
+				}
+				for _, pair := range pairs {
+					pairCh <- pair
+				}
+			}
+
+			if nextCursor == 0 {
+				return
+			}
+			cursor = nextCursor
+		}
+	}()
+
+	return pairCh, errCh
+}
+
 func (r *Redis) keys(regex string) ([]string, error) {
-	const (
-		startCursor  = 0
-		endCursor    = 0
-		defaultCount = 10
-	)
+	if cc, ok := r.client.(*redis.ClusterClient); ok {
+		return r.keysCluster(cc, regex)
+	}
+	return r.scanKeys(r.client, regex)
+}
 
+// scanKeys walks the keyspace with repeated SCANs, following the cursor
+// SCAN returns rather than restarting from 0 every call, until it comes
+// back around to 0.
+func (r *Redis) scanKeys(c cmdable, regex string) ([]string, error) {
 	var allKeys []string
 
-	nextCursor, keys, err := r.client.Scan(startCursor, regex, defaultCount).Result()
+	cursor := int64(0)
+	for {
+		nextCursor, keys, err := c.Scan(cursor, regex, r.scanCount).Result()
+		if err != nil {
+			return nil, err
+		}
+		allKeys = append(allKeys, keys...)
+		if nextCursor == 0 {
+			break
+		}
+		cursor = nextCursor
+	}
+	if len(allKeys) == 0 {
+		return nil, store.ErrKeyNotFound
+	}
+	return allKeys, nil
+}
+
+// keysCluster fans the SCAN walk out to every master in the cluster and
+// aggregates the results, since a single cursor only ever covers the
+// slots owned by one node. *redis.ClusterClient doesn't expose its
+// per-node clients, so the masters are found via CLUSTER SLOTS and each
+// is reached through its own short-lived *redis.Client instead.
+func (r *Redis) keysCluster(cc *redis.ClusterClient, regex string) ([]string, error) {
+	slots, err := cc.ClusterSlots().Result()
 	if err != nil {
 		return nil, err
 	}
-	allKeys = append(allKeys, keys...)
-	for nextCursor != endCursor {
-		nextCursor, keys, err = r.client.Scan(startCursor, regex, defaultCount).Result()
-		if err != nil {
+
+	masters := make(map[string]bool)
+	for _, slot := range slots {
+		if len(slot.Addrs) > 0 {
+			masters[slot.Addrs[0]] = true
+		}
+	}
+
+	var allKeys []string
+	for addr := range masters {
+		master := redis.NewClient(&redis.Options{
+			Addr:     addr,
+			Password: r.password,
+		})
+		keys, err := r.scanKeys(master, regex)
+		master.Close()
+		if err != nil && err != store.ErrKeyNotFound {
 			return nil, err
 		}
 		allKeys = append(allKeys, keys...)
@@ -173,114 +481,312 @@ func (r *Redis) keys(regex string) ([]string, error) {
 	return allKeys, nil
 }
 
-// mget values given their keys
+// mget values given their keys, MGETting in chunks of mgetChunkSize
+// pipelined together in one round trip so a large tree doesn't ship an
+// unbounded multi-bulk request.
 func (r *Redis) mget(keys ...string) ([]*store.KVPair, error) {
-	replies, err := r.client.MGet(keys...).Result()
-	if err != nil {
+	chunks := r.keyBatches(keys)
+
+	pipe := newPipeline(r.client)
+	defer pipe.Close()
+
+	cmds := make([]*redis.SliceCmd, len(chunks))
+	for i, chunk := range chunks {
+		cmds[i] = pipe.MGet(chunk...)
+	}
+
+	var versionCmds []*redis.SliceCmd
+	if !r.codec.EmbedsVersion() {
+		versionCmds = make([]*redis.SliceCmd, len(chunks))
+		for i, chunk := range chunks {
+			versionKeys := make([]string, len(chunk))
+			for j, key := range chunk {
+				versionKeys[j] = versionKey(key)
+			}
+			versionCmds[i] = pipe.MGet(versionKeys...)
+		}
+	}
+
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
 		return nil, err
 	}
 
 	var pairs []*store.KVPair
-	for index, reply := range replies {
-		var sreply string
-		key := keys[index]
-		if _, ok := reply.(string); ok {
-			sreply = reply.(string)
+	for i, chunk := range chunks {
+		replies, err := cmds[i].Result()
+		if err != nil {
+			return nil, err
 		}
-		if sreply == "" {
-			// empty reply
-			continue
+
+		var versionReplies []interface{}
+		if versionCmds != nil {
+			versionReplies, err = versionCmds[i].Result()
+			if err != nil {
+				return nil, err
+			}
 		}
 
-		vv := &versionedValue{}
-		vv.unmarshal([]byte(sreply))
-		pairs = append(pairs, &store.KVPair{
-			Key:       key,
-			Value:     vv.Value,
-			LastIndex: vv.Version,
-		})
+		for index, reply := range replies {
+			sreply, _ := reply.(string)
+			if sreply == "" {
+				// empty reply
+				continue
+			}
+			key := chunk[index]
+
+			var versionRaw []byte
+			if versionReplies != nil {
+				if s, ok := versionReplies[index].(string); ok {
+					versionRaw = []byte(s)
+				}
+			}
+
+			value, version := r.codec.Decode([]byte(sreply), versionRaw)
+			pairs = append(pairs, &store.KVPair{
+				Key:       key,
+				Value:     value,
+				LastIndex: version,
+			})
+		}
 	}
 	return pairs, nil
 }
 
-// DeleteTree deletes a range of keys under a given directory
+// DeleteTree deletes a range of keys under a given directory, DELeting
+// in chunks of mgetChunkSize pipelined together in one round trip.
 func (r *Redis) DeleteTree(directory string) error {
-	var allKeys []string
-	regex := r.normalize(directory) + "*" // for all keyed with $directory
+	regex := r.normalizePrefix(directory) + "*" // for all keyed with $directory
 	allKeys, err := r.keys(regex)
 	if err != nil {
 		return err
 	}
-	return r.client.Del(allKeys...).Err()
+	if !r.codec.EmbedsVersion() {
+		for _, key := range allKeys {
+			allKeys = append(allKeys, versionKey(key))
+		}
+	}
+	return r.delChunked(allKeys)
+}
+
+// delChunked pipelines DEL across chunks of mgetChunkSize keys.
+func (r *Redis) delChunked(keys []string) error {
+	pipe := newPipeline(r.client)
+	defer pipe.Close()
+
+	for _, chunk := range r.keyBatches(keys) {
+		pipe.Del(chunk...)
+	}
+	_, err := pipe.Exec()
+	return err
+}
+
+// keyBatches splits keys into chunks of at most mgetChunkSize elements
+// for pipelined MGET/DEL. In cluster mode it first groups keys by slot,
+// since keys no longer share a single global slot (see normalize) and a
+// multi-key command can't straddle two of them.
+func (r *Redis) keyBatches(keys []string) [][]string {
+	if !r.cluster {
+		return chunkStrings(keys, mgetChunkSize)
+	}
+
+	var batches [][]string
+	for _, group := range groupBySlot(keys) {
+		batches = append(batches, chunkStrings(group, mgetChunkSize)...)
+	}
+	return batches
+}
+
+// chunkStrings splits keys into slices of at most size elements.
+func chunkStrings(keys []string, size int) [][]string {
+	var chunks [][]string
+	for len(keys) > 0 {
+		n := size
+		if n > len(keys) {
+			n = len(keys)
+		}
+		chunks = append(chunks, keys[:n])
+		keys = keys[n:]
+	}
+	return chunks
 }
 
 // Atomic CAS operation on a single value.
 // Pass previous = nil to create a new key.
-// NOTE: we haven't introduce script on this page yet.
-// We perform read-modify-write on two separated operations which is not atomic guaranteed
+// When the codec embeds the version in the value itself, this is a
+// single EVALSHA round trip (see casPutScript). Codecs that can't embed
+// the version (e.g. rawCodec) instead use WATCH/MULTI/EXEC against the
+// sibling version key, since the script can no longer see the version by
+// just decoding the primary key's value.
 func (r *Redis) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
-	existedOne, err := r.Get(key)
-	if err != nil && err != store.ErrKeyNotFound {
-		return false, nil, err
+	if !r.codec.EmbedsVersion() {
+		return r.atomicPutWatch(key, value, previous, options)
 	}
-	if previous == nil && existedOne != nil {
-		return false, nil, store.ErrKeyModified
+	return r.atomicPutScript(key, value, previous, options)
+}
+
+func (r *Redis) atomicPutScript(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	expirationAfter := noExpiration
+	if options != nil {
+		expirationAfter = options.TTL
 	}
+
+	nkey := r.normalize(key)
+	version := timeBasedVersion()
+	raw, _ := r.codec.Encode(value, version)
+
+	mustExist := "0"
+	prevVersion := "0"
 	if previous != nil {
-		if existedOne == nil {
-			return false, nil, store.ErrKeyModified
-		}
-		// check existed == previous
-		if existedOne.LastIndex != previous.LastIndex {
-			return false, nil, store.ErrKeyModified
-		}
-		// ok for now, delete first, so setnx can work
-		if err := r.Delete(key); err != nil {
-			return false, nil, err
-		}
+		mustExist = "1"
+		prevVersion = strconv.FormatUint(previous.LastIndex, 10)
+	}
+	ttlMS := "0"
+	if expirationAfter > 0 {
+		ttlMS = strconv.FormatInt(int64(expirationAfter/time.Millisecond), 10)
+	}
+
+	reply, err := r.evalCAS(&r.putScriptSHA, casPutScript,
+		[]string{nkey},
+		[]string{string(raw), mustExist, prevVersion, ttlMS},
+	)
+	if err != nil {
+		return false, nil, err
 	}
+	if reply == 0 {
+		return false, nil, store.ErrKeyModified
+	}
+
+	return true, &store.KVPair{
+		Key:       key,
+		Value:     value,
+		LastIndex: version,
+	}, nil
+}
 
-	// write
+// atomicPutWatch implements AtomicPut for codecs whose sibling version
+// key must be checked and written alongside the primary key, using
+// Redis's optimistic-locking WATCH/MULTI/EXEC (via the *redis.Multi
+// Watch opens) instead of a Lua script.
+func (r *Redis) atomicPutWatch(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
 	expirationAfter := noExpiration
 	if options != nil {
 		expirationAfter = options.TTL
 	}
+
 	nkey := r.normalize(key)
-	vv := versionedValue{
-		Value:   value,
-		Version: timeBasedVersion(),
+	vkey := versionKey(nkey)
+	version := timeBasedVersion()
+	raw, versionRaw := r.codec.Encode(value, version)
+
+	multi, err := r.client.Watch(vkey)
+	if err != nil {
+		return false, nil, err
+	}
+	defer multi.Close()
+
+	existingVersionRaw, err := multi.Get(vkey).Bytes()
+	if err != nil && err != redis.Nil {
+		return false, nil, err
+	}
+	exists := err != redis.Nil
+
+	if (previous == nil) == exists {
+		return false, nil, store.ErrKeyModified
+	}
+	if previous != nil {
+		_, existingVersion := r.codec.Decode(nil, existingVersionRaw)
+		if existingVersion != previous.LastIndex {
+			return false, nil, store.ErrKeyModified
+		}
 	}
-	if err := r.client.SetNX(nkey, string(vv.marshal()), expirationAfter).Err(); err != nil {
+
+	if _, err := multi.Exec(func() error {
+		multi.Set(nkey, string(raw), expirationAfter)
+		multi.Set(vkey, string(versionRaw), expirationAfter)
+		return nil
+	}); err != nil {
+		if err == redis.TxFailedErr {
+			return false, nil, store.ErrKeyModified
+		}
 		return false, nil, err
 	}
+
 	return true, &store.KVPair{
-		Key:       nkey,
-		Value:     vv.Value,
-		LastIndex: vv.Version,
+		Key:       key,
+		Value:     value,
+		LastIndex: version,
 	}, nil
 }
 
-// Atomic delete of a single value
-// NOTE: we haven't introduce script on this page yet.
-// We perform read-modify-write on two separated operations which is not atomic guaranteed
+// Atomic delete of a single value. See AtomicPut for why the codec
+// determines whether this runs as a single EVALSHA or as WATCH/MULTI/EXEC.
 func (r *Redis) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
-	existedOne, err := r.Get(key)
-	if err != nil && err != store.ErrKeyNotFound {
+	if !r.codec.EmbedsVersion() {
+		return r.atomicDeleteWatch(key, previous)
+	}
+	return r.atomicDeleteScript(key, previous)
+}
+
+func (r *Redis) atomicDeleteScript(key string, previous *store.KVPair) (bool, error) {
+	nkey := r.normalize(key)
+
+	mustExist := "0"
+	prevVersion := "0"
+	if previous != nil {
+		mustExist = "1"
+		prevVersion = strconv.FormatUint(previous.LastIndex, 10)
+	}
+
+	reply, err := r.evalCAS(&r.delScriptSHA, casDelScript,
+		[]string{nkey},
+		[]string{mustExist, prevVersion},
+	)
+	if err != nil {
 		return false, err
 	}
-	if previous == nil && existedOne != nil {
+	if reply == 0 {
+		return false, store.ErrKeyModified
+	}
+	return true, nil
+}
+
+func (r *Redis) atomicDeleteWatch(key string, previous *store.KVPair) (bool, error) {
+	nkey := r.normalize(key)
+	vkey := versionKey(nkey)
+
+	multi, err := r.client.Watch(vkey)
+	if err != nil {
+		return false, err
+	}
+	defer multi.Close()
+
+	existingVersionRaw, err := multi.Get(vkey).Bytes()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	exists := err != redis.Nil
+
+	if (previous == nil) == exists {
 		return false, store.ErrKeyModified
 	}
 	if previous != nil {
-		if existedOne == nil {
+		_, existingVersion := r.codec.Decode(nil, existingVersionRaw)
+		if existingVersion != previous.LastIndex {
 			return false, store.ErrKeyModified
 		}
-		// check existed == previous
-		if existedOne.LastIndex != previous.LastIndex {
+	}
+
+	if _, err := multi.Exec(func() error {
+		multi.Del(nkey)
+		multi.Del(vkey)
+		return nil
+	}); err != nil {
+		if err == redis.TxFailedErr {
 			return false, store.ErrKeyModified
 		}
+		return false, err
 	}
-	return true, r.Delete(key)
+	return true, nil
 }
 
 // Close the store connection
@@ -289,5 +795,29 @@ func (r *Redis) Close() {
 }
 
 func (r *Redis) normalize(key string) string {
-	return store.Normalize(key)
+	nkey := store.Normalize(key)
+	if r.cluster {
+		// Hash-tag each key with its own name, so a key and its sibling
+		// version key (versionKey just appends outside the braces) always
+		// land on the same slot, while different keys still spread across
+		// the cluster instead of all pinning to one shard.
+		return "{" + nkey + "}"
+	}
+	return nkey
+}
+
+// normalizePrefix is like normalize, but for a directory prefix that List,
+// ListCh and WatchTree glob-match with a trailing "*" rather than look up
+// directly. It must NOT close the hash tag brace: Redis glob matching
+// treats "{"/"}" as literal characters, so a stored key normalizes to
+// "{foo/bar}" and only a pattern of "{foo/*" (brace left open, "*"
+// swallowing "bar}") matches it — closing the brace before the "*"
+// (i.e. "{foo/}*") can never match, since no stored key ends the tag
+// right after the directory name.
+func (r *Redis) normalizePrefix(prefix string) string {
+	nkey := store.Normalize(prefix)
+	if r.cluster {
+		return "{" + nkey
+	}
+	return nkey
 }
@@ -0,0 +1,54 @@
+package redis
+
+import "testing"
+
+func TestChunkStrings(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e"}
+
+	chunks := chunkStrings(keys, 2)
+	want := [][]string{{"a", "b"}, {"c", "d"}, {"e"}}
+
+	if len(chunks) != len(want) {
+		t.Fatalf("chunkStrings returned %d chunks, want %d", len(chunks), len(want))
+	}
+	for i := range want {
+		if len(chunks[i]) != len(want[i]) {
+			t.Fatalf("chunk %d = %v, want %v", i, chunks[i], want[i])
+		}
+		for j := range want[i] {
+			if chunks[i][j] != want[i][j] {
+				t.Fatalf("chunk %d = %v, want %v", i, chunks[i], want[i])
+			}
+		}
+	}
+}
+
+// TestKeyBatchesClusterGroupsBySlot checks that in cluster mode
+// keyBatches never puts keys from different slots in the same batch,
+// since mget/delChunked issue each batch as a single MGET/DEL that
+// Redis Cluster would reject if it straddled two slots.
+func TestKeyBatchesClusterGroupsBySlot(t *testing.T) {
+	r := &Redis{cluster: true}
+	keys := []string{"{a}1", "{b}1", "{a}2", "{a}3", "{b}2"}
+
+	for _, batch := range r.keyBatches(keys) {
+		slot := clusterSlot(batch[0])
+		for _, key := range batch {
+			if clusterSlot(key) != slot {
+				t.Fatalf("batch %v mixes keys from different cluster slots", batch)
+			}
+		}
+	}
+}
+
+// TestKeyBatchesNonClusterIgnoresSlot checks that outside cluster mode
+// keyBatches falls back to plain size-based chunking.
+func TestKeyBatchesNonClusterIgnoresSlot(t *testing.T) {
+	r := &Redis{cluster: false}
+	keys := []string{"{a}1", "{b}1", "{a}2"}
+
+	batches := r.keyBatches(keys)
+	if len(batches) != 1 || len(batches[0]) != 3 {
+		t.Fatalf("keyBatches(non-cluster) = %v, want a single batch of all 3 keys", batches)
+	}
+}
@@ -0,0 +1,206 @@
+package redis
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hsinhoyeh/libkv/store"
+
+	"gopkg.in/redis.v3"
+)
+
+// watchDebounce coalesces bursts of keyspace events (e.g. from DeleteTree
+// fanning out many DELs) into a single re-read within this window.
+const watchDebounce = 20 * time.Millisecond
+
+// ErrWatchUnsupportedInCluster is returned by Watch/WatchTree in cluster
+// mode: gopkg.in/redis.v3's *redis.ClusterClient has no PSubscribe, and
+// keyspace notifications in a real Redis Cluster are per-node anyway, so
+// there's no single pubsub connection this client version could use.
+var ErrWatchUnsupportedInCluster = errors.New("redis: Watch/WatchTree are not supported in cluster mode")
+
+// keyspaceChannel returns the keyspace notification pubsub pattern for a
+// normalized key or prefix, scoped to the selected DB (Config.Bucket) so
+// Watch/WatchTree see events for the DB they actually read and write.
+func (r *Redis) keyspaceChannel(pattern string) string {
+	return "__keyspace@" + strconv.FormatInt(r.db, 10) + "__:" + pattern
+}
+
+// pubsubClient returns r.client as a *redis.Client, the only cmdable
+// implementation PSubscribe exists on: gopkg.in/redis.v3 doesn't expose
+// PSubscribe on *redis.ClusterClient at all, since pubsub in real Redis
+// Cluster deployments needs its own fan-out that this client version
+// doesn't implement.
+func (r *Redis) pubsubClient() (*redis.Client, error) {
+	c, ok := r.client.(*redis.Client)
+	if !ok {
+		return nil, ErrWatchUnsupportedInCluster
+	}
+	return c, nil
+}
+
+// ensureKeyspaceNotifications makes a best-effort attempt to turn on
+// keyspace notifications for key-set/delete/expiry events. Watch and
+// WatchTree depend on this being enabled; on managed Redis where CONFIG
+// SET is disallowed, operators must set `notify-keyspace-events KEA` (or
+// at least `Kg$lshzxet`) themselves.
+func (r *Redis) ensureKeyspaceNotifications() {
+	r.client.ConfigSet("notify-keyspace-events", "KEA")
+}
+
+// Watch for changes on a key
+func (r *Redis) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	client, err := r.pubsubClient()
+	if err != nil {
+		return nil, err
+	}
+	r.watchOnce.Do(r.ensureKeyspaceNotifications)
+
+	nkey := r.normalize(key)
+	pubsub, err := client.PSubscribe(r.keyspaceChannel(nkey))
+	if err != nil {
+		return nil, err
+	}
+
+	watchCh := make(chan *store.KVPair)
+
+	go func() {
+		defer pubsub.Close()
+		defer close(watchCh)
+
+		events, errs := r.receiveKeyspaceEvents(pubsub)
+
+		pair, err := r.Get(key)
+		if err != nil && err != store.ErrKeyNotFound {
+			return
+		}
+		if !sendKVPair(watchCh, pair, stopCh) {
+			return
+		}
+
+		debounced(events, errs, stopCh, func() bool {
+			pair, err := r.Get(key)
+			if err != nil && err != store.ErrKeyNotFound {
+				return false
+			}
+			return sendKVPair(watchCh, pair, stopCh)
+		})
+	}()
+
+	return watchCh, nil
+}
+
+// WatchTree watches for changes on child nodes under
+// a given directory
+func (r *Redis) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	client, err := r.pubsubClient()
+	if err != nil {
+		return nil, err
+	}
+	r.watchOnce.Do(r.ensureKeyspaceNotifications)
+
+	prefix := r.normalizePrefix(directory)
+	pubsub, err := client.PSubscribe(r.keyspaceChannel(prefix + "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	watchCh := make(chan []*store.KVPair)
+
+	go func() {
+		defer pubsub.Close()
+		defer close(watchCh)
+
+		events, errs := r.receiveKeyspaceEvents(pubsub)
+
+		pairs, err := r.List(directory)
+		if err != nil && err != store.ErrKeyNotFound {
+			return
+		}
+		if !sendKVPairs(watchCh, pairs, stopCh) {
+			return
+		}
+
+		debounced(events, errs, stopCh, func() bool {
+			pairs, err := r.List(directory)
+			if err != nil && err != store.ErrKeyNotFound {
+				return false
+			}
+			return sendKVPairs(watchCh, pairs, stopCh)
+		})
+	}()
+
+	return watchCh, nil
+}
+
+// receiveKeyspaceEvents drains a PubSub connection on its own goroutine,
+// forwarding each notification (or the terminal error) onto channels the
+// caller can select on alongside stopCh.
+func (r *Redis) receiveKeyspaceEvents(pubsub *redis.PubSub) (<-chan struct{}, <-chan error) {
+	events := make(chan struct{})
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(events)
+		for {
+			if _, err := pubsub.ReceiveMessage(); err != nil {
+				errs <- err
+				return
+			}
+			events <- struct{}{}
+		}
+	}()
+
+	return events, errs
+}
+
+// debounced consumes events until stopCh fires or the pubsub connection
+// errors, invoking emit at most once per watchDebounce window.
+func debounced(events <-chan struct{}, errs <-chan error, stopCh <-chan struct{}, emit func() bool) {
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	pending := false
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-errs:
+			return
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+			if !pending {
+				pending = true
+				timer.Reset(watchDebounce)
+			}
+		case <-timer.C:
+			pending = false
+			if !emit() {
+				return
+			}
+		}
+	}
+}
+
+func sendKVPair(ch chan<- *store.KVPair, pair *store.KVPair, stopCh <-chan struct{}) bool {
+	select {
+	case ch <- pair:
+		return true
+	case <-stopCh:
+		return false
+	}
+}
+
+func sendKVPairs(ch chan<- []*store.KVPair, pairs []*store.KVPair, stopCh <-chan struct{}) bool {
+	select {
+	case ch <- pairs:
+		return true
+	case <-stopCh:
+		return false
+	}
+}
@@ -0,0 +1,79 @@
+package redis
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestKeyspaceChannel(t *testing.T) {
+	cases := []struct {
+		db      int64
+		pattern string
+		want    string
+	}{
+		{0, "foo", "__keyspace@0__:foo"},
+		{3, "foo*", "__keyspace@3__:foo*"},
+	}
+	for _, c := range cases {
+		r := &Redis{db: c.db}
+		if got := r.keyspaceChannel(c.pattern); got != c.want {
+			t.Errorf("keyspaceChannel(db=%d, %q) = %q, want %q", c.db, c.pattern, got, c.want)
+		}
+	}
+}
+
+// TestDebouncedCoalescesBurst checks that a burst of events within
+// watchDebounce triggers a single emit, not one per event.
+func TestDebouncedCoalescesBurst(t *testing.T) {
+	events := make(chan struct{})
+	errs := make(chan error)
+	stopCh := make(chan struct{})
+
+	var emits int
+	done := make(chan struct{})
+	go func() {
+		debounced(events, errs, stopCh, func() bool {
+			emits++
+			return true
+		})
+		close(done)
+	}()
+
+	for i := 0; i < 5; i++ {
+		events <- struct{}{}
+	}
+
+	time.Sleep(watchDebounce * 3)
+	close(stopCh)
+	<-done
+
+	if emits != 1 {
+		t.Fatalf("emits = %d, want 1 for a single burst within the debounce window", emits)
+	}
+}
+
+// TestDebouncedStopsOnError checks that debounced returns as soon as the
+// pubsub error channel fires, without waiting on a pending timer.
+func TestDebouncedStopsOnError(t *testing.T) {
+	events := make(chan struct{})
+	errs := make(chan error, 1)
+	stopCh := make(chan struct{})
+
+	done := make(chan struct{})
+	go func() {
+		debounced(events, errs, stopCh, func() bool {
+			t.Error("emit called after pubsub error")
+			return true
+		})
+		close(done)
+	}()
+
+	errs <- errors.New("pubsub closed")
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("debounced did not return after an error")
+	}
+}